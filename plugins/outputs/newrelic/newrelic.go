@@ -1,26 +1,51 @@
 package newrelic
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	ejson "encoding/json"
 	"fmt"
-	"os"
-
-	"bytes"
-	"github.com/influxdata/telegraf"
-	"github.com/influxdata/telegraf/plugins/outputs"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/plugins/outputs"
 )
 
 type (
 	NewRelic struct {
-		URL     string
-		License string
-		GUID string
-
-		client *http.Client
+		URL         string
+		License     string
+		LicenseFile string `toml:"license_file"`
+		GUID        string
+		MetricAPI   bool              `toml:"metric_api"`
+		Timeout     internal.Duration `toml:"timeout"`
+		DialTimeout internal.Duration `toml:"dial_timeout"`
+
+		// Interval is the reporting interval of the metrics being written,
+		// used to populate interval.ms on Metric API v2 data points. It
+		// should match the output's flush_interval.
+		Interval internal.Duration `toml:"interval"`
+
+		// TagKeysInPath includes tag keys (not just their values) in legacy
+		// Component paths, e.g. Component/cpu/region=us-east-1/usage instead
+		// of Component/cpu/us-east-1/usage. Defaults to true; set false to
+		// keep the old value-only paths existing dashboards may depend on.
+		TagKeysInPath bool `toml:"tag_keys_in_path"`
+
+		client     *http.Client
+		host       string
+		timeout    time.Duration
+		intervalMs int64
 	}
 
 	NRResponse struct {
@@ -54,55 +79,172 @@ type (
 		Components []NRComponent `json:"components"`
 	}
 
-	Aggregator struct {
-		Tags      string
-		Component NRComponent
+	// NRMetricV2 is a single dimensional metric as accepted by the Metric API v2
+	// (https://docs.newrelic.com/docs/data-apis/ingest-apis/metric-api/introduction-metric-api/).
+	NRMetricV2 struct {
+		Name       string            `json:"name"`
+		Type       string            `json:"type"`
+		Value      float64           `json:"value,omitempty"`
+		Timestamp  int64             `json:"timestamp"`
+		IntervalMs int64             `json:"interval.ms,omitempty"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+	}
+
+	// NRCommonBlock holds attributes shared by every metric in a NRMetricBatch.
+	NRCommonBlock struct {
+		Timestamp  int64             `json:"timestamp,omitempty"`
+		IntervalMs int64             `json:"interval.ms,omitempty"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+	}
+
+	NRMetricBatch struct {
+		Common  NRCommonBlock `json:"common,omitempty"`
+		Metrics []NRMetricV2  `json:"metrics"`
 	}
 )
 
-var request NRRequest
 var sanitizedChars = strings.NewReplacer("/", "_", " ", "", "%", "Percent", ":", "_", `\`, "_", "[", "", "]", "",
 	".", "", "#", "", "_", "")
 
 const (
-	newrelic_api = "https://platform-api.newrelic.com/platform/v1/metrics"
-	mimetype     = "application/json"
-	default_guid   = "com.influxdata.telegraf"
-	licence_header = "X-License-Key"
+	platformAPIURL = "https://platform-api.newrelic.com/platform/v1/metrics"
+	metricAPIURL   = "https://metric-api.newrelic.com/metric/v1"
+	mimetype       = "application/json"
+	defaultGUID    = "com.influxdata.telegraf"
+	licenseHeader  = "X-License-Key"
 	prefix         = "Component/"
-	sampleConfig   = `
-## NewRelic license key
+
+	// maxPayloadBytes caps the uncompressed size of each Metric API request
+	// body at New Relic's 1MB request limit, so that large writes are split
+	// into several requests up front instead of being rejected with a 413.
+	maxPayloadBytes = 1 << 20
+	maxRetries      = 4
+	baseBackoff     = 200 * time.Millisecond
+	maxBackoff      = 15 * time.Second
+
+	defaultTimeout     = 15 * time.Second
+	defaultDialTimeout = 5 * time.Second
+	defaultInterval    = 60 * time.Second
+
+	sampleConfig = `
+  ## NewRelic Insights API url, defaults to the legacy Platform API, or to
+  ## the Metric API when metric_api is set to true.
+  # url = ""
+
+  ## NewRelic license key. Supports $ENV expansion, or set license_file below
+  ## to read the key from a file instead of storing it inline.
   license = ""
-  ## Your newrelic plugin identifier
-  #guid = "com.influxdata.telegraf"
+  # license_file = "/etc/telegraf/newrelic_license"
+
+  ## Your newrelic plugin identifier. Can also be set via the NEW_RELIC_GUID
+  ## environment variable.
+  # guid = "com.influxdata.telegraf"
+
+  ## Send to the dimensional Metric API (metric-api.newrelic.com) instead of
+  ## the legacy Platform API. Defaults to false so existing deployments keep
+  ## posting to the Platform API until they opt in.
+  # metric_api = false
+
+  ## Reporting interval, used to populate interval.ms on Metric API v2 data
+  ## points. Should match this output's flush_interval.
+  # interval = "60s"
+
+  ## HTTP request timeout, bounding both the connect and read phases of a
+  ## single attempt.
+  # timeout = "15s"
+
+  ## TCP connect and TLS handshake timeout
+  # dial_timeout = "5s"
+
+  ## Include tag keys (not just values) in legacy Platform API Component
+  ## paths, e.g. "Component/cpu/region=us-east-1/usage" instead of
+  ## "Component/cpu/us-east-1/usage". Only applies when metric_api = false.
+  ## Disable to keep the old value-only paths existing dashboards expect.
+  # tag_keys_in_path = true
 `
 )
 
 func (n *NewRelic) Connect() error {
+	license, err := n.resolveLicense()
+	if err != nil {
+		return err
+	}
+	n.License = license
+
+	if n.GUID == "" {
+		n.GUID = defaultGUID
+	}
+	if envGUID := os.Getenv("NEW_RELIC_GUID"); envGUID != "" {
+		n.GUID = envGUID
+	}
+
 	if n.URL == "" {
-		n.URL = newrelic_api
+		if n.MetricAPI {
+			n.URL = metricAPIURL
+		} else {
+			n.URL = platformAPIURL
+		}
 	}
 
-	if n.License == "" {
-		return fmt.Errorf("Licence key is a required field for newrelic output")
+	n.timeout = n.Timeout.Duration
+	if n.timeout == 0 {
+		n.timeout = defaultTimeout
 	}
 
-	if n.GUID == "" {
-		n.GUID = default_guid
+	interval := n.Interval.Duration
+	if interval == 0 {
+		interval = defaultInterval
+	}
+	n.intervalMs = interval.Milliseconds()
+
+	dialTimeout := n.DialTimeout.Duration
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+
+	n.client = &http.Client{
+		Transport: &http.Transport{
+			Dial: (&net.Dialer{
+				Timeout: dialTimeout,
+			}).Dial,
+			TLSHandshakeTimeout: dialTimeout,
+		},
 	}
-	n.client = &http.Client{}
 
 	hostname, err := os.Hostname()
 	if err != nil {
-		return fmt.Errorf("FAILED to get hostname: %s, %s", hostname, err)
+		return fmt.Errorf("failed to get hostname: %s", err)
 	}
+	n.host = hostname
 
-	request.Agent.PID = os.Getpid()
-	request.Agent.Version = "1.0.0"
-	request.Agent.Host = hostname
 	return nil
 }
 
+// resolveLicense determines the license key to send, trying in order:
+// the License field with $ENV vars expanded (a License without $
+// references is used as is), and then the trimmed contents of
+// LicenseFile. It errors only if neither yields a non-empty key.
+func (n *NewRelic) resolveLicense() (string, error) {
+	// os.ExpandEnv is a no-op for a plain license string, so this covers
+	// both "License" and "os.ExpandEnv(License)" in a single step.
+	if license := os.ExpandEnv(n.License); license != "" {
+		return license, nil
+	}
+
+	if n.LicenseFile != "" {
+		contents, err := ioutil.ReadFile(n.LicenseFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read license_file %q: %s", n.LicenseFile, err)
+		}
+		if license := strings.TrimSpace(string(contents)); license != "" {
+			return license, nil
+		}
+	}
+
+	return "", fmt.Errorf("license key is a required field for newrelic output: set license, " +
+		"license as an $ENV reference, or license_file")
+}
+
 func (n *NewRelic) Close() error {
 	return nil
 }
@@ -120,126 +262,341 @@ func (n *NewRelic) Write(metrics []telegraf.Metric) error {
 		return nil
 	}
 
-	components := n.BuildComponents(&metrics)
-	request.Components = components
+	if n.MetricAPI {
+		return n.writeMetricAPI(metrics)
+	}
+	return n.writeLegacy(metrics)
+}
+
+// writeLegacy posts to the old Platform API, one unbounded request per Write call.
+func (n *NewRelic) writeLegacy(metrics []telegraf.Metric) error {
+	request := NRRequest{
+		Agent: NRAgent{
+			Host:    n.host,
+			Version: "1.0.0",
+			PID:     os.Getpid(),
+		},
+		Components: n.BuildComponents(&metrics),
+	}
 
-	return sendData(n, request)
+	return sendLegacy(n, request)
 }
 
-func serialize(m *telegraf.Metric) map[string]NRMetric {
-	// TODO: use a class
-	values := make(map[string]NRMetric)
-	tags := buildTags((*m).Tags())
-	// todo check m.Type()
-	for k, v := range (*m).Fields() {
-		var parts []string
-		var value float64
-		switch t := v.(type) {
-		case int:
-			value = float64(t)
-		case int32:
-			value = float64(t)
-		case int64:
-			value = float64(t)
-		case float64:
-			value = t
-		case bool:
-			if t {
-				value = 1
-			} else {
-				value = 0
+// writeMetricAPI posts to the dimensional Metric API, gzip-compressed and
+// split into chunks small enough to stay under maxPayloadBytes.
+func (n *NewRelic) writeMetricAPI(metrics []telegraf.Metric) error {
+	nrMetrics := n.buildMetricsV2(metrics)
+	if len(nrMetrics) == 0 {
+		return nil
+	}
+
+	for _, chunk := range chunkMetricsV2(nrMetrics, maxPayloadBytes) {
+		payload := []NRMetricBatch{{Metrics: chunk}}
+
+		body, err := ejson.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("unable to marshal metric API payload: %s", err)
+		}
+
+		gzipped, err := gzipBody(body)
+		if err != nil {
+			return fmt.Errorf("unable to gzip metric API payload: %s", err)
+		}
+
+		if err := n.postWithRetry(gzipped); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildMetricsV2 flattens telegraf metrics into Metric API v2 data points,
+// one per field, preserving every tag as an attribute.
+func (n *NewRelic) buildMetricsV2(metrics []telegraf.Metric) []NRMetricV2 {
+	var out []NRMetricV2
+
+	for _, m := range metrics {
+		attributes := make(map[string]string, len(m.Tags())+1)
+		for k, v := range m.Tags() {
+			attributes[k] = v
+		}
+		if _, ok := attributes["host"]; !ok {
+			attributes["host"] = n.host
+		}
+
+		metricType := "gauge"
+		if m.Type() == telegraf.Counter {
+			metricType = "count"
+		}
+
+		timestampMs := m.Time().UnixNano() / int64(time.Millisecond)
+
+		for field, fv := range m.Fields() {
+			value, ok := convertField(fv)
+			if !ok {
+				continue
 			}
-		default:
-			// Skip unsupported type.
-			continue
+
+			out = append(out, NRMetricV2{
+				Name:       m.Name() + "." + field,
+				Type:       metricType,
+				Value:      value,
+				Timestamp:  timestampMs,
+				IntervalMs: n.intervalMs,
+				Attributes: attributes,
+			})
 		}
+	}
 
-		mv := NRMetric{Total: value, Count: 1, Min: value, Max: value, SumOfSquares: value * value}
+	return out
+}
+
+// chunkMetricsV2 splits metrics into groups whose marshaled JSON size stays
+// under maxBytes, so a single Write never triggers a 413 from the API.
+func chunkMetricsV2(metrics []NRMetricV2, maxBytes int) [][]NRMetricV2 {
+	// The NRMetricBatch wrapper writeMetricAPI puts around each chunk's
+	// metrics array.
+	const overhead = len(`[{"common":{},"metrics":[]}]`)
+
+	var chunks [][]NRMetricV2
+	var current []NRMetricV2
+	currentSize := overhead
 
-		parts = append(parts, sanitizedChars.Replace((*m).Name()))
-		if (tags != "") {
-			parts = append(parts, tags)
+	for _, m := range metrics {
+		encoded, err := ejson.Marshal(m)
+		if err != nil {
+			continue
 		}
-		parts = append(parts, sanitizedChars.Replace(k))
+		itemSize := len(encoded) + 1 // +1 for the separating comma
 
-		values[prefix + strings.Join(parts,"/")] = mv
+		if len(current) > 0 && currentSize+itemSize > maxBytes {
+			chunks = append(chunks, current)
+			current = nil
+			currentSize = overhead
+		}
+
+		current = append(current, m)
+		currentSize += itemSize
 	}
 
-	return values
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+
+	return chunks
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-func equalsTags(lookupTable *map[string]Aggregator, search *telegraf.Metric) bool {
-	for name, lookup := range *lookupTable {
-		if (*search).Name() == name {
-			if buildTags((*search).Tags()) == lookup.Tags {
-				//if (reflect.DeepEqual((*search).Tags(), lookup.Tags)) {
-				return true
+// postOnce makes a single attempt at posting a gzip-encoded Metric API
+// payload. The request's connect and read phases are both bounded by
+// n.timeout via the request context, independent of any retries around it.
+func (n *NewRelic) postOnce(gzippedBody []byte) (statusCode int, body []byte, retryAfter string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", n.URL, bytes.NewReader(gzippedBody))
+	if err != nil {
+		return 0, nil, "", fmt.Errorf("unable to create http.Request: %s", err)
+	}
+	req.Header.Set("Content-Type", mimetype)
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept", mimetype)
+	req.Header.Set(licenseHeader, n.License)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, nil, "", fmt.Errorf("error POSTing metrics: %s", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, resp.Header.Get("Retry-After"), nil
+}
+
+// postWithRetry posts a gzip-encoded Metric API payload, retrying on
+// 408/429/5xx with exponential backoff and jitter, honoring Retry-After.
+func (n *NewRelic) postWithRetry(gzippedBody []byte) error {
+	var lastErr error
+
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		statusCode, body, retryAfter, err := n.postOnce(gzippedBody)
+		if err != nil {
+			lastErr = err
+			if attempt == maxRetries {
+				return lastErr
 			}
+			time.Sleep(backoffDuration(attempt))
+			continue
+		}
+
+		if statusCode >= 200 && statusCode < 300 {
+			return nil
+		}
+
+		lastErr = fmt.Errorf("received bad status code %d: %s", statusCode, body)
+		if !retryableStatus(statusCode) || attempt == maxRetries {
+			return lastErr
+		}
+
+		wait := retryAfterDuration(retryAfter)
+		if wait == 0 {
+			wait = backoffDuration(attempt)
+		}
+		time.Sleep(wait)
+	}
+
+	return lastErr
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return code >= 500
+}
+
+// backoffDuration returns an exponentially increasing delay with jitter,
+// capped at maxBackoff.
+func backoffDuration(attempt int) time.Duration {
+	d := baseBackoff * time.Duration(uint64(1)<<uint(attempt))
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+func retryAfterDuration(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func convertField(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case float64:
+		return t, true
+	case bool:
+		if t {
+			return 1, true
 		}
+		return 0, true
+	default:
+		// Skip unsupported type.
+		return 0, false
 	}
-	return false
 }
 
+// serialize flattens a metric's fields into Component-path-keyed NRMetric
+// samples, one per field. Each sample seeds Min/Max/Total from its own
+// value, since it represents a single observation; BuildComponents merges
+// samples that land on the same path across multiple metrics.
+func (n *NewRelic) serialize(m telegraf.Metric) map[string]NRMetric {
+	values := make(map[string]NRMetric)
+	tagPath := pathTags(m.Tags(), n.TagKeysInPath)
+
+	for k, v := range m.Fields() {
+		value, ok := convertField(v)
+		if !ok {
+			continue
+		}
+
+		mv := NRMetric{Total: value, Count: 1, Min: value, Max: value, SumOfSquares: value * value}
+
+		var parts []string
+		parts = append(parts, sanitizedChars.Replace(m.Name()))
+		if tagPath != "" {
+			parts = append(parts, tagPath)
+		}
+		parts = append(parts, sanitizedChars.Replace(k))
+
+		values[prefix+strings.Join(parts, "/")] = mv
+	}
+
+	return values
+}
+
+// BuildComponents groups metrics into one NRComponent per distinct
+// (name, tagset) series, keyed by a canonical tag representation so that
+// series differing only in how their tags are split (e.g. region=us,
+// east=1 vs region=us-east-1) are never confused with one another.
 func (n *NewRelic) BuildComponents(metrics *[]telegraf.Metric) []NRComponent {
-	var aggregator = make(map[string]Aggregator)
+	aggregator := make(map[string]*NRComponent)
 
 	for _, metric := range *metrics {
-		name := metric.Name()
-		if _, ok := aggregator[name]; ok {
-			if equalsTags(&aggregator, &metric) {
-				// add metrics values
-				for k, v := range serialize(&metric) {
-					t, exists := aggregator[name].Component.Metrics[k]
-					t.Count += 1
-					t.Total += v.Total
-					t.SumOfSquares += v.SumOfSquares
-					if !exists || v.Total > t.Max {
-						t.Max = v.Total
-					}
-					if !exists || v.Total < t.Min {
-						t.Min = v.Total
-					}
-					aggregator[name].Component.Metrics[k] = t
-				}
-
-			} else {
-				// add metrics to component
-				for k, v := range serialize(&metric) {
-					aggregator[name].Component.Metrics[k] = v
-				}
-			}
-		} else {
-			// new component
-			var host string
-			if metric.HasTag("host") {
-				host = metric.Tags()["host"]
-				//metric.RemoveTag("host")
-			} else {
-				host = request.Agent.Host
-			}
+		host := n.host
+		if metric.HasTag("host") {
+			host = metric.Tags()["host"]
+		}
+		key := metric.Name() + "\x00" + host + "\x00" + canonicalTagKey(metric.Tags())
 
-			var c = NRComponent{
+		c, ok := aggregator[key]
+		if !ok {
+			c = &NRComponent{
 				Name:     host,
 				Duration: 60, // TODO find duration
-				Metrics:  serialize(&metric),
-				GUID:     n.GUID, //+ metric.Name(),
+				Metrics:  make(map[string]NRMetric),
+				GUID:     n.GUID,
 			}
-			aggregator[name] = Aggregator{
-				Tags:      buildTags(metric.Tags()),
-				Component: c,
+			aggregator[key] = c
+		}
+
+		for path, v := range n.serialize(metric) {
+			t, exists := c.Metrics[path]
+			if !exists {
+				c.Metrics[path] = v
+				continue
 			}
+
+			t.Count += v.Count
+			t.Total += v.Total
+			t.SumOfSquares += v.SumOfSquares
+			if v.Max > t.Max {
+				t.Max = v.Max
+			}
+			if v.Min < t.Min {
+				t.Min = v.Min
+			}
+			c.Metrics[path] = t
 		}
 	}
 
-	var temp []NRComponent
-	for _, lookup := range aggregator {
-		temp = append(temp, lookup.Component)
+	components := make([]NRComponent, 0, len(aggregator))
+	for _, c := range aggregator {
+		components = append(components, *c)
 	}
 
-	return temp
+	return components
 }
 
-func buildTags(tags map[string]string) string {
+// tagKeys returns a metric's tag keys, excluding "host" (which is folded
+// into the component name), sorted for deterministic ordering.
+func tagKeys(tags map[string]string) []string {
 	var keys []string
 	for k := range tags {
 		if k == "host" {
@@ -248,77 +605,104 @@ func buildTags(tags map[string]string) string {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
+	return keys
+}
 
-	var tag_str string
+// canonicalTagKey renders a tagset, minus "host" (which BuildComponents
+// keys on separately), as a sorted "k"="v","k"="v" string of quoted keys
+// and values used purely to group metrics into series; it always includes
+// keys so that distinct tagsets can never collide.
+func canonicalTagKey(tags map[string]string) string {
+	keys := tagKeys(tags)
+	pairs := make([]string, len(keys))
 	for i, k := range keys {
-		var tag_value string
-		if tags[k] == "/" {
-			tag_value = "ROOT"
+		pairs[i] = strconv.Quote(k) + "=" + strconv.Quote(tags[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// pathTags renders a metric's tags for inclusion in a legacy Component
+// path. With keysInPath it sanitizes and joins "k=v" pairs so that series
+// like region=us-east-1 and region=us,east=1 can't collide on the same
+// path; otherwise it falls back to the old value-only joining.
+func pathTags(tags map[string]string, keysInPath bool) string {
+	keys := tagKeys(tags)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		value := tags[k]
+		if value == "/" {
+			value = "ROOT"
 		} else {
-			tag_value = sanitizedChars.Replace(tags[k])
+			value = sanitizedChars.Replace(value)
 		}
-		if i == 0 {
-			tag_str += /* k + "/" +*/ tag_value
+		if keysInPath {
+			parts = append(parts, sanitizedChars.Replace(k)+"="+value)
 		} else {
-			tag_str += /*"/" + k + */ "/" + tag_value
+			parts = append(parts, value)
 		}
 	}
-	return tag_str
+	return strings.Join(parts, "/")
 }
 
-func sendData(n *NewRelic, request NRRequest) error {
+func sendLegacy(n *NewRelic, request NRRequest) error {
 	reqbody, err := ejson.Marshal(request)
 	if err != nil {
-		return fmt.Errorf("unable to marshal request data: %s\n", err.Error())
+		return fmt.Errorf("unable to marshal request data: %s", err.Error())
 	}
 
-	req, err := http.NewRequest("POST", n.URL, bytes.NewBuffer(reqbody))
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", n.URL, bytes.NewBuffer(reqbody))
 	if err != nil {
-		return fmt.Errorf("unable to create http.Request: %s\n", err.Error())
+		return fmt.Errorf("unable to create http.Request: %s", err.Error())
 	}
 	req.Header.Add("Content-Type", mimetype)
 	req.Header.Set("Accept", mimetype)
-	req.Header.Set(licence_header, n.License)
+	req.Header.Set(licenseHeader, n.License)
 
 	resp, err := n.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error POSTing metrics, %s\n", err.Error())
+		return fmt.Errorf("error POSTing metrics, %s", err.Error())
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode > 209 {
 		switch resp.StatusCode {
 		case 400, 404, 405:
-			return fmt.Errorf("Status %d: maybe update agent", resp.StatusCode)
+			return fmt.Errorf("status %d: maybe update agent", resp.StatusCode)
 		case 403:
-			return fmt.Errorf("Authentication error (no license key header, or invalid license key).")
+			return fmt.Errorf("authentication error (no license key header, or invalid license key)")
 		case 413:
-			return fmt.Errorf("Request entity too large: Too many metrics were sent in one request")
+			return fmt.Errorf("request entity too large: too many metrics were sent in one request")
 		case 500, 502, 503, 504:
-			return fmt.Errorf("Status %d: Newrelic API not available", resp.StatusCode)
+			return fmt.Errorf("status %d: newrelic API not available", resp.StatusCode)
 		default:
-			return fmt.Errorf("received bad status code: %d\n", resp.StatusCode)
+			return fmt.Errorf("received bad status code: %d", resp.StatusCode)
 		}
-
 	}
 
 	body, _ := ioutil.ReadAll(resp.Body)
 
 	nrresp := NRResponse{}
 	if err := ejson.Unmarshal(body, &nrresp); err != nil {
-		return fmt.Errorf("received bad response data: %s %s\n", body, err)
+		return fmt.Errorf("received bad response data: %s %s", body, err)
 	}
 
 	if nrresp.Error != "" {
-		return fmt.Errorf("NewRelic error: %s\n", nrresp.Error)
+		return fmt.Errorf("newrelic error: %s", nrresp.Error)
 	}
 	if nrresp.Status != "ok" {
-		return fmt.Errorf("NewRelic Status not ok: %s\n", nrresp.Status)
+		return fmt.Errorf("newrelic status not ok: %s", nrresp.Status)
 	}
 	return nil
 }
 
 func init() {
 	outputs.Add("newrelic", func() telegraf.Output {
-		return &NewRelic{}
+		return &NewRelic{
+			GUID:          defaultGUID,
+			TagKeysInPath: true,
+		}
 	})
 }
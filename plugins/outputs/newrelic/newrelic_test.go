@@ -1,30 +1,26 @@
 package newrelic
 
 import (
+	"compress/gzip"
 	ejson "encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
-
-	"github.com/influxdata/telegraf/testutil"
+	"time"
 
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
 	"github.com/influxdata/telegraf/metric"
-	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"io/ioutil"
-	"os"
-	"strconv"
-	"strings"
-	"time"
 )
 
 const (
-	fakelicence        = "dummy"
-	fakehostname       = "testhostname"
-	responseOK         = `{"status": "ok"}`
-	responseForceError = `{"error":"force error"}`
+	fakelicence = "dummy"
 )
 
 var (
@@ -44,295 +40,381 @@ var (
 		},
 		time.Now(),
 	)
-	m3, _ = metric.New("m1",
-		map[string]string{"tag1": "tagvalue1"},
-		map[string]interface{}{
-			"value1": float64(2),
-			"value2": float64(9),
-		},
-		time.Now(),
-	)
-	m4, _ = metric.New("m1",
-		map[string]string{"tag1": "tagvalue2"},
-		map[string]interface{}{
-			"value1": float64(1),
-			"value2": float64(2),
-		},
-		time.Now(),
-	)
-	m5, _ = metric.New("m1",
-		map[string]string{"tag1": "tagvalue1"},
-		map[string]interface{}{
-			"asdf1": float64(3),
-			"asdf2": float64(4),
-		},
-		time.Now(),
-	)
 )
 
-func initServer(t *testing.T) *httptest.Server {
+func decodeBody(t *testing.T, r *http.Request) []byte {
+	var reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		defer gz.Close()
+		body, err := ioutil.ReadAll(gz)
+		require.NoError(t, err)
+		return body
+	}
+	body, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	return body
+}
+
+// TestWriteLegacy exercises the legacy Platform API path, which must keep
+// working unchanged for operators who haven't migrated yet.
+func TestWriteLegacy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert := require.New(t)
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+		assert.Equal(fakelicence, r.Header.Get("X-License-Key"))
+
+		body := decodeBody(t, r)
+		var req NRRequest
+		require.NoError(t, ejson.Unmarshal(body, &req))
+		require.Len(t, req.Components, 2) // m1 and m2 are distinct measurements
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"status": "ok"}`)
+	}))
+	defer server.Close()
+
+	n := NewRelic{
+		URL:     server.URL,
+		License: fakelicence,
+	}
+	require.NoError(t, n.Connect())
+	require.NoError(t, n.Write([]telegraf.Metric{m1, m2}))
+}
+
+// TestWriteMetricAPI exercises the dimensional Metric API path: gzip body,
+// per-field metrics, and tags carried through as attributes.
+func TestWriteMetricAPI(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		contenttype := r.Header.Get("Content-Type")
-		accept := r.Header.Get("Accept")
-		license := r.Header.Get("X-License-Key")
-		assert.Equal(t, "application/json", contenttype)
-		assert.Equal(t, "application/json", accept)
-		assert.NotEmpty(t, license)
+		require.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		require.Equal(t, fakelicence, r.Header.Get("X-License-Key"))
+
+		body := decodeBody(t, r)
+		var batches []NRMetricBatch
+		require.NoError(t, ejson.Unmarshal(body, &batches))
+		require.Len(t, batches, 1)
+		require.Len(t, batches[0].Metrics, 4)
+
+		for _, m := range batches[0].Metrics {
+			require.Equal(t, "gauge", m.Type)
+			require.NotZero(t, m.Timestamp)
+			require.EqualValues(t, 60000, m.IntervalMs)
+			require.NotEmpty(t, m.Attributes)
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		if license == fakelicence {
-			if body, err := ioutil.ReadAll(r.Body); err == nil {
-				hostname, _ := os.Hostname()
-				var pid = os.Getpid()
-				var expectedTpl = `{
-					"agent": {
-						"host": "#HOSTNAME#",
-						"pid": #PID#,
-						"version": "1.0.0"
-					},
-					"components": [
-						{
-							"duration": "60",
-							"guid": "test.sonica.telegraf",
-							"name": "#HOSTNAME#",
-							"metrics": {
-								"Component/test1/value1/value":  {
-									"count": 1,
-									"total": 1.0,
-									"min": 1.0,
-									"max": 1.0,
-									"sum_of_squares": 1.0
-								}
-							}
-						}
-					]
-				}`
-				var hostnameReplacer = strings.NewReplacer("#HOSTNAME#", hostname, "#PID#", strconv.Itoa(pid))
-				var expected = hostnameReplacer.Replace(expectedTpl)
-				require.JSONEq(t, expected, fmt.Sprintf("%s", body))
-				w.WriteHeader(http.StatusOK)
-				fmt.Fprintln(w, responseOK)
-			} else {
-				w.WriteHeader(http.StatusOK)
-				fmt.Fprintln(w, responseForceError)
-			}
-		} else {
-			w.WriteHeader(http.StatusUnauthorized)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"status": "ok"}`)
+	}))
+	defer server.Close()
+
+	n := NewRelic{
+		URL:       server.URL,
+		License:   fakelicence,
+		MetricAPI: true,
+	}
+	require.NoError(t, n.Connect())
+	require.NoError(t, n.Write([]telegraf.Metric{m1, m2}))
+}
+
+func TestWriteMetricAPIUsesConfiguredInterval(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := decodeBody(t, r)
+		var batches []NRMetricBatch
+		require.NoError(t, ejson.Unmarshal(body, &batches))
+		for _, m := range batches[0].Metrics {
+			require.EqualValues(t, 10000, m.IntervalMs)
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"status": "ok"}`)
 	}))
-	return server
+	defer server.Close()
+
+	n := NewRelic{
+		URL:       server.URL,
+		License:   fakelicence,
+		MetricAPI: true,
+		Interval:  internal.Duration{Duration: 10 * time.Second},
+	}
+	require.NoError(t, n.Connect())
+	require.NoError(t, n.Write([]telegraf.Metric{m1}))
 }
 
-func TestRequestSerialize(t *testing.T) {
-	var request NRRequest
+// TestMetricAPIDefaultsToDisabled ensures an existing telegraf.conf with
+// only a license set keeps posting to the legacy Platform API unchanged,
+// rather than silently switching endpoints on upgrade.
+func TestMetricAPIDefaultsToDisabled(t *testing.T) {
+	n := NewRelic{License: fakelicence}
+	require.NoError(t, n.Connect())
+	require.Equal(t, platformAPIURL, n.URL)
+}
 
-	var c NRComponent
-	c.GUID = GUID
-	c.Duration = 60
-	c.Name = fakehostname
+func TestWriteMetricAPIChunksLargePayloads(t *testing.T) {
+	var requests int32
 
-	c.Metrics = make(map[string]NRMetric, 1)
-	c.Metrics["Component/test1/value1/value"] = NRMetric{Count: 1, Total: 1.0, Min: 1.0, Max: 1.0, SumOfSquares: 1.0}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
 
-	request.Agent.Host = fakehostname
-	request.Agent.PID = 42
-	request.Agent.Version = "1.0.0"
-	request.Components = append(request.Components, c)
+		body := decodeBody(t, r)
+		var batches []NRMetricBatch
+		require.NoError(t, ejson.Unmarshal(body, &batches))
+		require.Len(t, batches, 1)
 
-	buf, err := ejson.Marshal(request)
-	require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"status": "ok"}`)
+	}))
+	defer server.Close()
 
-	var expected = `{
-		"agent": {
-			"host": "testhostname",
-			"pid": 42,
-			"version": "1.0.0"
-		},
-		"components": [
-			{
-				"duration": "60",
-				"guid": "test.sonica.telegraf",
-				"name": "testhostname",
-				"metrics": {
-					"Component/test1/value1/value": {
-						"count": 1,
-						"total": 1.0,
-						"min": 1.0,
-						"max": 1.0,
-						"sum_of_squares": 1.0
-					}
-				}
-			}
-		]
-	}`
-
-	require.JSONEq(t, expected, fmt.Sprintf("%s", buf))
+	var metrics []telegraf.Metric
+	for i := 0; i < 20000; i++ {
+		m, err := metric.New("bigmetric",
+			map[string]string{"tag1": "tagvalue1", "index": fmt.Sprintf("%d", i)},
+			map[string]interface{}{"value": float64(i)},
+			time.Now(),
+		)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+
+	n := NewRelic{
+		URL:       server.URL,
+		License:   fakelicence,
+		MetricAPI: true,
+	}
+	require.NoError(t, n.Connect())
+	require.NoError(t, n.Write(metrics))
+	require.Greater(t, atomic.LoadInt32(&requests), int32(1))
 }
 
-func TestLicenceKeyHeader(t *testing.T) {
-	/*if testing.Short() {
-		t.Skip("Skipping integration test in short mode")
-	}*/
-	server := initServer(t)
+func TestWriteMetricAPIRetriesOnServerError(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"status": "ok"}`)
+	}))
 	defer server.Close()
 
-	i := NewRelic{
-		URL:     server.URL,
-		License: "nolicense",
+	n := NewRelic{
+		URL:       server.URL,
+		License:   fakelicence,
+		MetricAPI: true,
 	}
+	require.NoError(t, n.Connect())
+	require.NoError(t, n.Write([]telegraf.Metric{m1}))
+	require.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestWriteMetricAPIGivesUpOnNonRetryableStatus(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	n := NewRelic{
+		URL:       server.URL,
+		License:   fakelicence,
+		MetricAPI: true,
+	}
+	require.NoError(t, n.Connect())
+	require.Error(t, n.Write([]telegraf.Metric{m1}))
+	require.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
+
+func TestResolveLicensePrefersLicenseField(t *testing.T) {
+	n := NewRelic{License: "from-config"}
+	license, err := n.resolveLicense()
+	require.NoError(t, err)
+	require.Equal(t, "from-config", license)
+}
+
+func TestResolveLicenseFromEnv(t *testing.T) {
+	require.NoError(t, os.Setenv("NEWRELIC_TEST_LICENSE", "from-env"))
+	defer os.Unsetenv("NEWRELIC_TEST_LICENSE")
+
+	n := NewRelic{License: "$NEWRELIC_TEST_LICENSE"}
+	license, err := n.resolveLicense()
+	require.NoError(t, err)
+	require.Equal(t, "from-env", license)
+}
+
+func TestResolveLicenseFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "license")
+	require.NoError(t, ioutil.WriteFile(path, []byte("from-file\n"), 0600))
+
+	n := NewRelic{LicenseFile: path}
+	license, err := n.resolveLicense()
+	require.NoError(t, err)
+	require.Equal(t, "from-file", license)
+}
 
-	err := i.Connect()
-	metrics := testutil.MockMetrics()
-	err = i.Write(metrics)
+func TestResolveLicenseMissingFileErrors(t *testing.T) {
+	n := NewRelic{LicenseFile: filepath.Join(t.TempDir(), "missing")}
+	_, err := n.resolveLicense()
 	require.Error(t, err)
 }
 
-func TestWrite(t *testing.T) {
-	/*if testing.Short() {
-		t.Skip("Skipping integration test in short mode")
-	}*/
-	server := initServer(t)
+func TestResolveLicenseAllEmptyErrors(t *testing.T) {
+	n := NewRelic{}
+	_, err := n.resolveLicense()
+	require.Error(t, err)
+}
+
+func TestGUIDFromEnv(t *testing.T) {
+	require.NoError(t, os.Setenv("NEW_RELIC_GUID", "env.guid"))
+	defer os.Unsetenv("NEW_RELIC_GUID")
+
+	n := NewRelic{License: fakelicence}
+	require.NoError(t, n.Connect())
+	require.Equal(t, "env.guid", n.GUID)
+}
+
+// TestWriteLegacyTimesOutOnSlowServer exercises sendLegacy's single attempt
+// (no retries), so the timeout window can be asserted precisely.
+func TestWriteLegacyTimesOutOnSlowServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"status": "ok"}`)
+	}))
 	defer server.Close()
 
-	i := NewRelic{
+	n := NewRelic{
 		URL:     server.URL,
 		License: fakelicence,
+		Timeout: internal.Duration{Duration: 20 * time.Millisecond},
 	}
+	require.NoError(t, n.Connect())
 
-	err := i.Connect()
-	metrics := testutil.MockMetrics()
-	err = i.Write(metrics)
-	require.NoError(t, err)
+	start := time.Now()
+	err := n.Write([]telegraf.Metric{m1})
+	elapsed := time.Since(start)
+
+	require.Error(t, err)
+	require.Less(t, elapsed, 500*time.Millisecond)
 }
 
-func TestMultiplyWrite(t *testing.T) {
-	/*if testing.Short() {
-		t.Skip("Skipping integration test in short mode")
-	}*/
-	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if body, err := ioutil.ReadAll(r.Body); err == nil {
-			hostname, _ := os.Hostname()
-			var pid = os.Getpid()
-			var expectedTpl = `{
-				"agent": {
-					"host": "#HOSTNAME#",
-					"pid": #PID#,
-					"version": "1.0.0"
-				},
-				"components": [
-					{
-						"duration": "60",
-						"guid": "test.sonica.telegraf",
-						"name": "#HOSTNAME#",
-						"metrics": {
-							"Component/m1/tagvalue1/value1":  {
-								"total": 5,
-								"count" : 2,
-								"min": 2,
-								"max": 3,
-								"sum_of_squares": 13
-							},
-							"Component/m1/tagvalue1/value2":  {
-								"total": 13,
-								"count" : 2,
-								"min": 4,
-								"max": 9,
-								"sum_of_squares":97
-							},
-							"Component/m1/tagvalue2/value1": {
-								"total": 1,
-								"count" : 1,
-								"min": 1,
-								"max": 1,
-								"sum_of_squares": 1
-							},
-							"Component/m1/tagvalue2/value2": {
-								"total": 2,
-								"count" : 1,
-								"min": 2,
-								"max": 2,
-								"sum_of_squares": 4
-							},
-							"Component/m1/tagvalue1/asdf1": {
-								"total": 3,
-								"count" : 1,
-								"min": 3,
-								"max": 3,
-								"sum_of_squares":9
-							},
-							"Component/m1/tagvalue1/asdf2": {
-								"total": 4,
-								"count" : 1,
-								"min": 4,
-								"max": 4,
-								"sum_of_squares":16
-							}
-						}
-					},
-					{
-						"duration": "60",
-						"guid": "test.sonica.telegraf",
-						"name": "#HOSTNAME#",
-						"metrics": {
-							"Component/m2/tagvalue2/v1": {
-								"total": 6,
-								"count" : 1,
-								"min": 6,
-								"max": 6,
-								"sum_of_squares": 36
-							},
-							"Component/m2/tagvalue2/v2":  {
-								"total": 8,
-								"count" : 1,
-								"min": 8,
-								"max": 8,
-								"sum_of_squares": 64
-							}
-						}
-					}
-				]
-			}`
-			var hostnameReplacer = strings.NewReplacer("#HOSTNAME#", hostname, "#PID#", strconv.Itoa(pid))
-			var expected = hostnameReplacer.Replace(expectedTpl)
-			require.JSONEq(t, expected, fmt.Sprintf("%s", body))
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintln(w, responseOK)
-		} else {
-			w.WriteHeader(http.StatusOK)
-			w.Header().Set("Content-Type", "application/json")
-			fmt.Fprintln(w, responseForceError)
+// TestBuildComponentsDistinguishesCollidingTagValues ensures series that
+// would collide under the old value-only path (region=us,east=1 vs
+// region=us-east-1) are kept as distinct series once tag keys are included
+// in both the aggregation key and the path.
+func TestBuildComponentsDistinguishesCollidingTagValues(t *testing.T) {
+	collide1, _ := metric.New("cpu",
+		map[string]string{"region": "us", "east": "1"},
+		map[string]interface{}{"usage": float64(10)},
+		time.Now(),
+	)
+	collide2, _ := metric.New("cpu",
+		map[string]string{"region": "us-east-1"},
+		map[string]interface{}{"usage": float64(20)},
+		time.Now(),
+	)
+
+	n := NewRelic{GUID: "test.guid", TagKeysInPath: true}
+
+	metrics := []telegraf.Metric{collide1, collide2}
+	components := n.BuildComponents(&metrics)
+	require.Len(t, components, 2)
+
+	var paths []string
+	for _, c := range components {
+		for path := range c.Metrics {
+			paths = append(paths, path)
 		}
-	}))
-	defer s.Close()
+	}
+	require.Len(t, paths, 2)
+	require.NotEqual(t, paths[0], paths[1])
+}
 
-	i := NewRelic{
-		URL:     s.URL,
-		License: fakelicence,
+// TestBuildComponentsAggregatesSameSeries ensures multiple points for the
+// same (name, tagset) series are merged, rather than the last one clobbering
+// the rest, and that Min/Max are seeded from the first observed value.
+func TestBuildComponentsAggregatesSameSeries(t *testing.T) {
+	a, _ := metric.New("cpu", map[string]string{"host": "h"}, map[string]interface{}{"usage": float64(5)}, time.Now())
+	b, _ := metric.New("cpu", map[string]string{"host": "h"}, map[string]interface{}{"usage": float64(2)}, time.Now())
+	c, _ := metric.New("cpu", map[string]string{"host": "h"}, map[string]interface{}{"usage": float64(9)}, time.Now())
+
+	n := NewRelic{GUID: "test.guid"}
+	metrics := []telegraf.Metric{a, b, c}
+	components := n.BuildComponents(&metrics)
+	require.Len(t, components, 1)
+
+	path := prefix + "cpu/usage"
+	m, ok := components[0].Metrics[path]
+	require.True(t, ok)
+	require.Equal(t, 3, m.Count)
+	require.Equal(t, 16.0, m.Total)
+	require.Equal(t, 2.0, m.Min)
+	require.Equal(t, 9.0, m.Max)
+}
+
+// TestBuildComponentsInterleavesMultipleSeries covers multi-tag, multi-series
+// metrics arriving interleaved, making sure each series gets its own
+// component and aggregate instead of bleeding into another.
+func TestBuildComponentsInterleavesMultipleSeries(t *testing.T) {
+	a1, _ := metric.New("cpu", map[string]string{"core": "0"}, map[string]interface{}{"usage": float64(1)}, time.Now())
+	b1, _ := metric.New("cpu", map[string]string{"core": "1"}, map[string]interface{}{"usage": float64(10)}, time.Now())
+	a2, _ := metric.New("cpu", map[string]string{"core": "0"}, map[string]interface{}{"usage": float64(3)}, time.Now())
+	b2, _ := metric.New("cpu", map[string]string{"core": "1"}, map[string]interface{}{"usage": float64(20)}, time.Now())
+
+	n := NewRelic{GUID: "test.guid", TagKeysInPath: true}
+	metrics := []telegraf.Metric{a1, b1, a2, b2}
+	components := n.BuildComponents(&metrics)
+	require.Len(t, components, 2)
+
+	totals := make(map[string]float64)
+	for _, c := range components {
+		for path, m := range c.Metrics {
+			totals[path] = m.Total
+		}
 	}
+	require.Equal(t, 4.0, totals[prefix+"cpu/core=0/usage"])
+	require.Equal(t, 30.0, totals[prefix+"cpu/core=1/usage"])
+}
 
-	err := i.Connect()
-	metrics := []telegraf.Metric{m1, m2, m3, m4, m5}
-	err = i.Write(metrics)
-	require.NoError(t, err)
+// TestBuildComponentsSeparatesDistinctMeasurements ensures metrics with
+// different names land in separate components when no host is set to
+// distinguish them.
+func TestBuildComponentsSeparatesDistinctMeasurements(t *testing.T) {
+	n := NewRelic{GUID: "test.guid"}
+	components := n.BuildComponents(&[]telegraf.Metric{m1, m2})
+	require.Len(t, components, 2)
+}
+
+// TestPathTagsLegacyValueOnly covers the back-compat tag_keys_in_path=false
+// path, which keeps joining tag values without their keys, and contrasts it
+// with the keyed form used when tag_keys_in_path=true.
+func TestPathTagsLegacyValueOnly(t *testing.T) {
+	tags := map[string]string{"b": "2", "a": "1"}
+	require.Equal(t, "1/2", pathTags(tags, false))
+	require.Equal(t, "a=1/b=2", pathTags(tags, true))
 }
 
-func TestForceError(t *testing.T) {
-	/*if testing.Short() {
-		t.Skip("Skipping integration test in short mode")
-	}*/
+func TestWriteLegacyForceError(t *testing.T) {
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
 		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintln(w, responseForceError)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"error":"force error"}`)
 	}))
 	defer s.Close()
 
-	i := NewRelic{
+	n := NewRelic{
 		URL:     s.URL,
 		License: fakelicence,
 	}
-
-	err := i.Connect()
-	metrics := testutil.MockMetrics()
-	err = i.Write(metrics)
-	require.Error(t, err)
+	require.NoError(t, n.Connect())
+	require.Error(t, n.Write([]telegraf.Metric{m1}))
 }